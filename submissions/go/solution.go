@@ -2,59 +2,2267 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"runtime"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+const defaultInput = "data/test_measurements.txt"
+
+// maxLineSize bounds the length of a single input line read through a
+// bufio.Scanner. Longer lines abort the scan with bufio.ErrTooLong.
+const maxLineSize = 1 << 20
+
+// maxRound is the most decimal places -round accepts. float64 has about
+// 15 significant digits, and math.Pow10 overflows well before -round
+// could usefully go higher.
+const maxRound = 15
+
+// maxMismatches limits how many differing lines -expected reports.
+const maxMismatches = 10
+
+// cancelCheckInterval is how many lines processReader reads between
+// checks for context cancellation.
+const cancelCheckInterval = 100000
+
+// progressBatch is how many lines a parser counts locally before
+// publishing them to the shared progress counter.
+const progressBatch = 1 << 16
+
+// progressInterval is how often -progress reports on stderr.
+const progressInterval = time.Second
+
+// defaultStationsHint is the number of stations the per-station map is
+// sized for up front. The challenge dataset has a few hundred.
+const defaultStationsHint = 1024
+
+// maxOutlierExamples limits how many station names the -range warning
+// lists.
+const maxOutlierExamples = 5
+
+// followMarker separates the snapshots -follow prints.
+const followMarker = "---"
+
+// binaryMagic starts every file written by the encode subcommand. The
+// last byte is the format version.
+var binaryMagic = []byte("BRCB\x01")
+
+// utf8BOM is the byte order mark some editors write at the start of UTF-8
+// files. It is not part of the first station name.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// utf16BOMs start UTF-16 text, which cannot be parsed byte-wise.
+var utf16BOMs = [][]byte{{0xff, 0xfe}, {0xfe, 0xff}}
+
+// errUTF16 reports input that starts with a UTF-16 byte order mark.
+var errUTF16 = errors.New("input is UTF-16 encoded; convert it to UTF-8 first")
+
+// gzipMagic is the two-byte header that starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// stats holds the running aggregate for a single station. Temperatures
+// are stored as fixed-point tenths of a degree.
+type stats struct {
+	min, max int32
+	sum      int64
+	sumSq    int64 // sum of squared tenths, for the standard deviation
+	count    int64
+
+	// values retains every reading when a median is requested. It costs
+	// four bytes per input row, so it is only filled in on demand.
+	values []int32
+
+	// runs takes the place of values when repeats are collapsed: each
+	// entry is a reading and how many times the station reported it in a
+	// row. It costs twelve bytes per run, so it only pays off for inputs
+	// with long runs of repeated readings.
+	runs []valueRun
+}
+
+// valueRun is a reading repeated n times in a row.
+type valueRun struct {
+	temp int32
+	n    int64
+}
+
+// keep retains temp for the median, in values or, if collapse is set, in
+// runs.
+func (s *stats) keep(temp int32, collapse bool) {
+	if !collapse {
+		s.values = append(s.values, temp)
+		return
+	}
+	if last := len(s.runs) - 1; last >= 0 && s.runs[last].temp == temp {
+		s.runs[last].n++
+		return
+	}
+	s.runs = append(s.runs, valueRun{temp: temp, n: 1})
+}
+
+func (s *stats) add(temp int32) {
+	if s.count == 0 || temp < s.min {
+		s.min = temp
+	}
+	if s.count == 0 || temp > s.max {
+		s.max = temp
+	}
+	s.sum += int64(temp)
+	s.sumSq += int64(temp) * int64(temp)
+	s.count++
+}
+
+func (s *stats) merge(o *stats) {
+	if o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.sum += o.sum
+	s.sumSq += o.sumSq
+	s.count += o.count
+	s.values = append(s.values, o.values...)
+	s.runs = append(s.runs, o.runs...)
+}
+
+// mean returns the average temperature in degrees. The division by
+// count happens in tenths so an exact half-tenth such as 2.05 survives
+// for roundTo.
+func (s *stats) mean() float64 {
+	return float64(s.sum) / float64(s.count) / 10
+}
+
+// stddev returns the population standard deviation in degrees, computed
+// as sqrt(sumSq/count - mean²). The sums are exact integers, so the only
+// rounding happens in this final step; a float accumulator would need
+// Welford's algorithm to avoid losing precision on large inputs.
+func (s *stats) stddev() float64 {
+	mean := float64(s.sum) / float64(s.count)
+	variance := float64(s.sumSq)/float64(s.count) - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return math.Sqrt(variance) / 10
+}
+
+// median returns the median temperature in degrees, averaging the two
+// middle readings when there is an even number of them. It sorts values
+// or runs in place and returns NaN if none were retained.
+func (s *stats) median() float64 {
+	if len(s.runs) > 0 {
+		return s.medianOfRuns()
+	}
+	if len(s.values) == 0 {
+		return math.NaN()
+	}
+	sort.Slice(s.values, func(i, j int) bool { return s.values[i] < s.values[j] })
+	mid := len(s.values) / 2
+	if len(s.values)%2 == 1 {
+		return float64(s.values[mid]) / 10
+	}
+	return float64(s.values[mid-1]+s.values[mid]) / 20
+}
+
+// medianOfRuns is median for readings collapsed into runs. It needs time
+// and memory proportional to the number of runs, not readings.
+func (s *stats) medianOfRuns() float64 {
+	sort.Slice(s.runs, func(i, j int) bool { return s.runs[i].temp < s.runs[j].temp })
+	var total int64
+	for _, run := range s.runs {
+		total += run.n
+	}
+	// nth returns the reading at index k of the sorted readings.
+	nth := func(k int64) int32 {
+		for _, run := range s.runs {
+			if k < run.n {
+				return run.temp
+			}
+			k -= run.n
+		}
+		return s.runs[len(s.runs)-1].temp
+	}
+	if total%2 == 1 {
+		return float64(nth(total/2)) / 10
+	}
+	return float64(nth(total/2-1)+nth(total/2)) / 20
+}
+
+// roundTo rounds x to n decimal places, with halves rounded towards
+// positive infinity as in the reference 1BRC implementation. Plain %.1f
+// would round 2.05 down to 2.0 instead of up to 2.1.
+func roundTo(x float64, n int) float64 {
+	p := math.Pow10(n)
+	return math.Floor(x*p+0.5) / p
+}
+
+// formatTemp renders a temperature in degrees with precision decimal
+// places. A negative precision prints v unrounded, with as many digits
+// as it takes to represent it exactly.
+func formatTemp(v float64, precision int) string {
+	if precision < 0 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(roundTo(v, precision), 'f', precision, 64)
+}
+
+// parseTemp parses a temperature with one fractional digit, such as
+// "-12.3", into tenths of a degree (-123). The fractional part may be
+// left out entirely, so "25" is read as 25.0 (250). The challenge
+// documents readings in the range -99.9 to 99.9; up to three integer
+// digits are accepted. ok is false if b is not in that form.
+func parseTemp(b []byte) (temp int32, ok bool) {
+	neg := false
+	if len(b) > 0 && b[0] == '-' {
+		neg = true
+		b = b[1:]
+	}
+	digits, frac := b, byte('0')
+	if n := len(b); n >= 2 && b[n-2] == '.' {
+		digits, frac = b[:n-2], b[n-1]
+	}
+	if len(digits) < 1 || len(digits) > 3 {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		temp = temp*10 + int32(c-'0')
+	}
+	if frac < '0' || frac > '9' {
+		return 0, false
+	}
+	temp = temp*10 + int32(frac-'0')
+	if neg {
+		temp = -temp
+	}
+	return temp, true
+}
+
+// tempRange is an inclusive range of temperatures in tenths of a degree.
+type tempRange struct {
+	min, max int32
+}
+
+// parseInterval parses a -interval value: a number of seconds such as
+// "5" or "0.5", or a time.ParseDuration string such as "500ms". The
+// interval must be positive.
+func parseInterval(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("%q is neither a number of seconds nor a duration such as 5s", v)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q must be positive", v)
+	}
+	return d, nil
+}
+
+// parseRange parses a min:max range such as "-99.9:99.9".
+func parseRange(v string) (*tempRange, error) {
+	lo, hi, found := strings.Cut(v, ":")
+	if !found {
+		return nil, fmt.Errorf("range %q is not of the form min:max", v)
+	}
+	min, ok := parseTemp([]byte(lo))
+	if !ok {
+		return nil, fmt.Errorf("range %q has an invalid minimum", v)
+	}
+	max, ok := parseTemp([]byte(hi))
+	if !ok {
+		return nil, fmt.Errorf("range %q has an invalid maximum", v)
+	}
+	if min > max {
+		return nil, fmt.Errorf("range %q has its minimum above its maximum", v)
+	}
+	return &tempRange{min: min, max: max}, nil
+}
+
+func (r *tempRange) contains(temp int32) bool {
+	return temp >= r.min && temp <= r.max
+}
+
+// skipCounts tallies input lines that could not be aggregated.
+type skipCounts struct {
+	separator int64 // no separator between station and temperature
+	number    int64 // temperature did not parse
+}
+
+func (c skipCounts) total() int64 {
+	return c.separator + c.number
+}
+
+// parseOptions controls how input lines are parsed and what is collected.
+type parseOptions struct {
+	sep          byte  // separates station name from temperature
+	delim        byte  // terminates each record, normally '\n'
+	foldCase     bool  // merge station names that differ only in case
+	keepValues   bool  // retain every reading in stats.values
+	collapseRuns bool  // retain readings as stats.runs instead
+	limit        int64 // stop after this many parsed rows; 0 means no limit
+	skipHeader   bool  // ignore the first line of each input
+	stationsHint int   // expected number of distinct stations
+	binary       bool  // input is in the encode subcommand's format
+	checkOnly    bool  // count valid rows without building stations
+
+	// plausible, if set, is the range outside which readings count as
+	// outliers. They are aggregated unless dropOutliers is set.
+	plausible    *tempRange
+	dropOutliers bool
+
+	// progress, if set, is advanced by the number of lines read.
+	progress *atomic.Int64
+}
+
+// aggregation is the result of parsing some input: per-station stats and
+// the lines that were skipped along the way.
+type aggregation struct {
+	opts     parseOptions
+	stations map[string]*stats
+	skipped  skipCounts
+	rows     int64 // lines aggregated into stations
+	pending  int64 // lines not yet added to opts.progress
+
+	// outliers counts readings outside opts.plausible; outlierNames holds
+	// the first few distinct stations that reported one.
+	outliers     int64
+	outlierNames []string
+
+	// suspectHeader is the first input line if it was kept but its
+	// temperature did not parse, suggesting a header row.
+	suspectHeader string
+}
+
+func newAggregation(opts parseOptions) *aggregation {
+	return &aggregation{opts: opts, stations: make(map[string]*stats, opts.stationsHint)}
+}
+
+// addLine parses a single station=temperature line, using opts.sep in
+// place of =. The line is split at the last separator, so station names
+// may contain it. A trailing \r left over from a CRLF line ending is
+// ignored; lines that are not of that form are counted as skipped.
+func (a *aggregation) addLine(line []byte) {
+	a.countLine()
+
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+
+	sep := bytes.LastIndexByte(line, a.opts.sep)
+	if sep < 0 {
+		a.skipped.separator++
+		return
+	}
+	temp, ok := parseTemp(line[sep+1:])
+	if !ok {
+		a.skipped.number++
+		return
+	}
+	name := line[:sep]
+	if a.opts.foldCase {
+		name = bytes.ToLower(name)
+	}
+	a.addReading(name, temp)
+}
+
+// addReading adds one temperature for the station called name, which has
+// already been case folded if opts.foldCase is set.
+func (a *aggregation) addReading(name []byte, temp int32) {
+	if a.outlier(name, temp) && a.opts.dropOutliers {
+		return
+	}
+	if a.opts.checkOnly {
+		a.rows++
+		return
+	}
+	a.addTo(a.station(name), temp)
+}
+
+// outlier reports whether temp falls outside opts.plausible, counting it
+// against name if so.
+func (a *aggregation) outlier(name []byte, temp int32) bool {
+	if a.opts.plausible == nil || a.opts.plausible.contains(temp) {
+		return false
+	}
+	a.addOutlier(string(name))
+	return true
+}
+
+// station returns the stats for name, creating them on first use.
+func (a *aggregation) station(name []byte) *stats {
+	st := a.stations[string(name)]
+	if st == nil {
+		st = &stats{}
+		a.stations[string(name)] = st
+	}
+	return st
+}
+
+// addTo adds temp to st, one of a's stations.
+func (a *aggregation) addTo(st *stats, temp int32) {
+	st.add(temp)
+	if a.opts.keepValues {
+		st.keep(temp, a.opts.collapseRuns)
+	}
+	a.rows++
+}
+
+// addOutlier records an out-of-range reading from station.
+func (a *aggregation) addOutlier(station string) {
+	a.outliers++
+	a.noteOutlierName(station)
+}
+
+// noteOutlierName adds station to outlierNames unless it is already
+// listed or the list is full.
+func (a *aggregation) noteOutlierName(station string) {
+	if len(a.outlierNames) >= maxOutlierExamples {
+		return
+	}
+	for _, name := range a.outlierNames {
+		if name == station {
+			return
+		}
+	}
+	a.outlierNames = append(a.outlierNames, station)
+}
+
+// checkHeader looks at the first line of an input. It reports false if
+// the line should be dropped because opts.skipHeader is set; otherwise it
+// records the line in suspectHeader when its temperature does not parse.
+func (a *aggregation) checkHeader(line []byte) bool {
+	if a.opts.skipHeader {
+		return false
+	}
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if sep := bytes.LastIndexByte(line, a.opts.sep); sep >= 0 {
+		if _, ok := parseTemp(line[sep+1:]); !ok {
+			a.suspectHeader = string(line)
+		}
+	}
+	return true
+}
+
+// countLine notes one more input line for -progress, publishing them in
+// batches of progressBatch.
+func (a *aggregation) countLine() {
+	if a.opts.progress != nil {
+		a.pending++
+		if a.pending == progressBatch {
+			a.flushProgress()
+		}
+	}
+}
+
+// done reports whether opts.limit rows have been aggregated.
+func (a *aggregation) done() bool {
+	return a.opts.limit > 0 && a.rows >= a.opts.limit
+}
+
+// flushProgress publishes the locally counted lines to opts.progress.
+func (a *aggregation) flushProgress() {
+	if a.opts.progress != nil {
+		a.opts.progress.Add(a.pending)
+		a.pending = 0
+	}
+}
+
+// merge folds o into a. o must not be used afterwards.
+func (a *aggregation) merge(o *aggregation) {
+	for station, st := range o.stations {
+		if merged, ok := a.stations[station]; ok {
+			merged.merge(st)
+		} else {
+			a.stations[station] = st
+		}
+	}
+	a.skipped.separator += o.skipped.separator
+	a.skipped.number += o.skipped.number
+	a.rows += o.rows
+	a.outliers += o.outliers
+	for _, name := range o.outlierNames {
+		a.noteOutlierName(name)
+	}
+}
+
+// newLineScanner returns a scanner over the delim-terminated records in
+// r, allowing records up to maxLineSize.
+func newLineScanner(r io.Reader, delim byte) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	if delim != '\n' {
+		scanner.Split(scanDelimited(delim))
+	}
+	return scanner
+}
+
+// processReader scans station=temperature lines from r and aggregates
+// them per station as they are read. It fails if r cannot be read, a
+// line exceeds maxLineSize or ctx is cancelled.
+func processReader(ctx context.Context, r io.Reader, opts parseOptions) (*aggregation, error) {
+	agg := newAggregation(opts)
+
+	br := bufio.NewReader(r)
+	if err := skipBOM(br); err != nil {
+		return nil, err
+	}
+	scanner := newLineScanner(br, opts.delim)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	first := true
+	for n := 1; !agg.done() && scanner.Scan(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if first {
+			first = false
+			if !agg.checkHeader(scanner.Bytes()) {
+				continue
+			}
+		}
+		agg.addLine(scanner.Bytes())
+	}
+	agg.flushProgress()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Input shorter than cancelCheckInterval lines is never checked in
+	// the loop.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return agg, nil
+}
+
+// Stats is the aggregate for one station, in degrees.
+type Stats struct {
+	Min, Max, Mean float64
+	Count          int64
+}
+
+// Aggregate reads station=temperature lines from r and returns the
+// aggregate for every station seen. Malformed lines are skipped.
+func Aggregate(r io.Reader) (map[string]Stats, error) {
+	return AggregateContext(context.Background(), r)
+}
+
+// AggregateContext is like Aggregate but stops early, returning
+// ctx.Err(), once ctx is cancelled.
+func AggregateContext(ctx context.Context, r io.Reader) (map[string]Stats, error) {
+	agg, err := processReader(ctx, r, parseOptions{sep: '=', delim: '\n', stationsHint: defaultStationsHint})
+	if err != nil {
+		return nil, err
+	}
+	return agg.export(), nil
+}
+
+// export converts the internal fixed-point stats to Stats.
+func (a *aggregation) export() map[string]Stats {
+	out := make(map[string]Stats, len(a.stations))
+	for station, st := range a.stations {
+		if st.count == 0 {
+			continue
+		}
+		out[station] = Stats{
+			Min:   float64(st.min) / 10,
+			Max:   float64(st.max) / 10,
+			Mean:  st.mean(),
+			Count: st.count,
+		}
+	}
+	return out
+}
+
+// stripBOM returns data without a leading UTF-8 byte order mark, or
+// errUTF16 if it starts with a UTF-16 one.
+func stripBOM(data []byte) ([]byte, error) {
+	for _, bom := range utf16BOMs {
+		if bytes.HasPrefix(data, bom) {
+			return nil, errUTF16
+		}
+	}
+	return bytes.TrimPrefix(data, utf8BOM), nil
+}
+
+// skipBOM is stripBOM for the start of a stream.
+func skipBOM(r *bufio.Reader) error {
+	head, _ := r.Peek(len(utf8BOM))
+	rest, err := stripBOM(head)
+	if err != nil {
+		return err
+	}
+	_, err = r.Discard(len(head) - len(rest))
+	return err
+}
+
+// gunzipIfCompressed returns a reader over the decompressed contents of r
+// when r starts with a gzip header, and r itself otherwise.
+func gunzipIfCompressed(r *bufio.Reader) (io.Reader, error) {
+	magic, _ := r.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return r, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// scanDelimited returns a bufio.SplitFunc that splits records on delim
+// the way bufio.ScanLines splits on newlines, including a final record
+// without a terminator.
+func scanDelimited(delim byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// parseDelim interprets the -delim flag: a single byte, or an escape
+// such as \n, \t, \0 or \x00.
+func parseDelim(v string) (byte, error) {
+	if len(v) == 1 {
+		return v[0], nil
+	}
+	if v == `\0` {
+		return 0, nil
+	}
+	r, _, tail, err := strconv.UnquoteChar(v, '\'')
+	if err != nil || tail != "" || r > 0xff {
+		return 0, fmt.Errorf("-delim must be a single byte, got %q", v)
+	}
+	return byte(r), nil
+}
+
+// processFile aggregates the file at path using the given number of
+// worker goroutines. Gzip-compressed files, named *.gz or starting with a
+// gzip header, are decompressed and scanned sequentially.
+func processFile(path string, workers int, opts parseOptions) (*aggregation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+		return processReader(context.Background(), zr, opts)
+	}
+	return processOpenFile(file, workers, opts)
+}
+
+// processOpenFile aggregates f, reading a regular file in parallel
+// sections and streaming anything else, such as a pipe. Gzip input and
+// -limit, whose first rows can only be found by reading in order, are
+// streamed as well.
+func processOpenFile(f *os.File, workers int, opts parseOptions) (*aggregation, error) {
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() && opts.limit == 0 {
+		agg, ok, err := processSections(f, info.Size(), max(workers, 1), opts)
+		if ok || err != nil {
+			return agg, err
+		}
+	}
+	r, err := gunzipIfCompressed(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return processReader(context.Background(), r, opts)
+}
+
+// unicodeLess orders a before b by comparing their runes with case folded
+// away, falling back to byte order so the result is a total order. This
+// keeps "paris" next to "Paris" and ranks multibyte names by code point
+// rather than by their UTF-8 bytes; it is not a locale-aware collation.
+func unicodeLess(a, b string) bool {
+	ia, ib := 0, 0
+	for ia < len(a) && ib < len(b) {
+		ra, na := utf8.DecodeRuneInString(a[ia:])
+		rb, nb := utf8.DecodeRuneInString(b[ib:])
+		if la, lb := unicode.ToLower(ra), unicode.ToLower(rb); la != lb {
+			return la < lb
+		}
+		ia += na
+		ib += nb
+	}
+	// One folded name is a prefix of the other; the shorter goes first.
+	// Falling back to byte order here would make "Ab" < "a" < "aa" < "Ab".
+	if ra, rb := len(a)-ia, len(b)-ib; ra != rb {
+		return ra < rb
+	}
+	return a < b
+}
+
+// combine returns the aggregate of every reading across stations. The
+// per-station values are not carried over.
+func combine(stations map[string]*stats) *stats {
+	total := &stats{}
+	for _, st := range stations {
+		shallow := *st
+		shallow.values = nil
+		shallow.runs = nil
+		total.merge(&shallow)
+	}
+	return total
+}
+
+// checkUnique returns an error naming the first station that appears
+// twice in the sorted slice names. The results come from a map, so this
+// only fires if merging partial results ever goes wrong.
+func checkUnique(names []string) error {
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			return fmt.Errorf("duplicate station %q in results", names[i])
+		}
+	}
+	return nil
+}
+
+// filterNames returns the names that contain substr, in their original
+// order. It reuses the backing array of names.
+func filterNames(names []string, substr string) []string {
+	kept := names[:0]
+	for _, name := range names {
+		if strings.Contains(name, substr) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// topByMean orders names by descending mean temperature, breaking ties
+// by name, and keeps at most n of them.
+func topByMean(names []string, stations map[string]*stats, n int) []string {
+	sort.Slice(names, func(i, j int) bool {
+		mi, mj := stations[names[i]].mean(), stations[names[j]].mean()
+		if mi != mj {
+			return mi > mj
+		}
+		return names[i] < names[j]
+	})
+	if n < len(names) {
+		names = names[:n]
+	}
+	return names
+}
+
+// report is a sorted set of results together with the columns to print.
+type report struct {
+	names    []string
+	stations map[string]*stats
+	mean     bool // include the mean
+	median   bool // include the median; needs retained values
+	stddev   bool // append the standard deviation
+
+	precision int // decimal places; negative prints full precision
+
+	// floatFormat, if set, is a fmt verb such as %+05.1f that replaces the
+	// default formatting of each temperature once it has been rounded.
+	floatFormat string
+
+	// summary, if set, combines every station and is printed after them
+	// as an ALL line.
+	summary         *stats
+	summaryStations int
+}
+
+// temp formats a temperature in degrees at the report's precision.
+func (r *report) temp(v float64) string {
+	if r.floatFormat == "" {
+		return formatTemp(v, r.precision)
+	}
+	if r.precision >= 0 {
+		v = roundTo(v, r.precision)
+	}
+	return fmt.Sprintf(r.floatFormat, v)
+}
+
+// checkFloatFormat reports whether format prints exactly one float64,
+// which fmt signals otherwise by writing a %! marker into its output.
+func checkFloatFormat(format string) error {
+	if out := fmt.Sprintf(format, 1.5); strings.Contains(out, "%!") {
+		return fmt.Errorf("%q does not format a single float: %s", format, out)
+	}
+	return nil
+}
+
+// columns returns the formatted temperatures for st in output order:
+// min, then the enabled averages, then max and the optional stddev.
+func (r *report) columns(st *stats) []string {
+	cols := []string{r.temp(float64(st.min) / 10)}
+	if r.mean {
+		cols = append(cols, r.temp(st.mean()))
+	}
+	if r.median {
+		cols = append(cols, r.temp(st.median()))
+	}
+	cols = append(cols, r.temp(float64(st.max)/10))
+	if r.stddev {
+		cols = append(cols, r.temp(st.stddev()))
+	}
+	return cols
+}
+
+// header names the values returned by columns.
+func (r *report) header() []string {
+	cols := []string{"min"}
+	if r.mean {
+		cols = append(cols, "mean")
+	}
+	if r.median {
+		cols = append(cols, "median")
+	}
+	cols = append(cols, "max")
+	if r.stddev {
+		cols = append(cols, "stddev")
+	}
+	return cols
+}
+
+// sortFields maps each -sort-by field to the value it orders stations
+// by. name has no entry: names start out in name order.
+var sortFields = map[string]func(*stats) float64{
+	"mean": (*stats).mean,
+	"min":  func(st *stats) float64 { return float64(st.min) },
+	"max":  func(st *stats) float64 { return float64(st.max) },
+}
+
+// sortByField reorders names, which must already be in name order, by
+// field: name, mean, min or max, ascending unless desc is set. Stations
+// that tie keep their name order.
+func sortByField(names []string, stations map[string]*stats, field string, desc bool) {
+	key, ok := sortFields[field]
+	if !ok {
+		if desc {
+			for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+				names[i], names[j] = names[j], names[i]
+			}
+		}
+		return
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		ki, kj := key(stations[names[i]]), key(stations[names[j]])
+		if desc {
+			return ki > kj
+		}
+		return ki < kj
+	})
+}
+
+// writeText prints one station=min/mean/max line per station in names
+// order, with the median in place of or after the mean and the stddev
+// after the max when requested, followed by the summary line if any.
+func writeText(w io.Writer, r *report) error {
+	for _, station := range r.names {
+		cols := r.columns(r.stations[station])
+		if _, err := fmt.Fprintf(w, "%s=%s\n", station, strings.Join(cols, "/")); err != nil {
+			return err
+		}
+	}
+	// With no readings at all the mean is undefined, so there is no ALL
+	// line to print.
+	if t := r.summary; t != nil && t.count > 0 {
+		_, err := fmt.Fprintf(w, "ALL=%s/%s/%s (count=%d, stations=%d)\n",
+			r.temp(float64(t.min)/10), r.temp(t.mean()), r.temp(float64(t.max)/10),
+			t.count, r.summaryStations)
+		return err
+	}
+	return nil
+}
+
+// writeCSV prints a header row followed by one row per station in names
+// order, quoting station names as needed.
+func writeCSV(w io.Writer, r *report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"station"}, r.header()...)); err != nil {
+		return err
+	}
+	for _, station := range r.names {
+		if err := cw.Write(append([]string{station}, r.columns(r.stations[station])...)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeTable prints the results as aligned columns under a header row:
+// station names on the left, temperatures right-aligned.
+func writeTable(w io.Writer, r *report) error {
+	width := utf8.RuneCountInString("station")
+	for _, station := range r.names {
+		if n := utf8.RuneCountInString(station); n > width {
+			width = n
+		}
+	}
+	// tabwriter right-aligns every cell, so names are padded to a common
+	// width first to keep them flush left, and the gap between columns is
+	// written into the cells rather than added as tabwriter padding.
+	pad := func(name string) string {
+		return name + strings.Repeat(" ", width-utf8.RuneCountInString(name))
+	}
+	row := func(name string, cols []string) string {
+		return pad(name) + "\t  " + strings.Join(cols, "\t  ") + "\t\n"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 0, ' ', tabwriter.AlignRight)
+	io.WriteString(tw, row("station", r.header()))
+	for _, station := range r.names {
+		io.WriteString(tw, row(station, r.columns(r.stations[station])))
+	}
+	return tw.Flush()
+}
+
+// jsonStats is the JSON form of a station's aggregate. The temperatures
+// are preformatted so they round exactly like the text output.
+type jsonStats struct {
+	Min    json.Number `json:"min"`
+	Mean   json.Number `json:"mean,omitempty"`
+	Median json.Number `json:"median,omitempty"`
+	Max    json.Number `json:"max"`
+	Stddev json.Number `json:"stddev,omitempty"`
+	Count  int64       `json:"count"`
+}
+
+func (r *report) jsonStats(st *stats) jsonStats {
+	js := jsonStats{
+		Min:   json.Number(r.temp(float64(st.min) / 10)),
+		Max:   json.Number(r.temp(float64(st.max) / 10)),
+		Count: st.count,
+	}
+	if r.mean {
+		js.Mean = json.Number(r.temp(st.mean()))
+	}
+	if r.median {
+		js.Median = json.Number(r.temp(st.median()))
+	}
+	if r.stddev {
+		js.Stddev = json.Number(r.temp(st.stddev()))
+	}
+	return js
+}
+
+// writeJSON prints a single JSON object keyed by station name, with the
+// keys in names order. As in the other formats, -median replaces the
+// mean unless -verbose is also given.
+func writeJSON(w io.Writer, r *report) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, station := range r.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(station)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(r.jsonStats(r.stations[station]))
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeComparison prints, for each station in either report, how its
+// mean, min and max changed from base to other, or that it was added or
+// removed. Lines are in the order given by sortNames.
+func writeComparison(w io.Writer, base, other *report, sortNames func([]string)) error {
+	// Which file a station is in depends on every station read, not only
+	// those -filter and -top left in names.
+	has := func(r *report, name string) bool {
+		st := r.stations[name]
+		return st != nil && st.count > 0
+	}
+	listed := make(map[string]bool, len(base.names))
+	for _, name := range base.names {
+		listed[name] = true
+	}
+	names := append([]string(nil), base.names...)
+	for _, name := range other.names {
+		if !listed[name] {
+			names = append(names, name)
+		}
+	}
+	sortNames(names)
+
+	for _, name := range names {
+		var err error
+		switch {
+		case !has(other, name):
+			_, err = fmt.Fprintf(w, "%s: removed\n", name)
+		case !has(base, name):
+			_, err = fmt.Fprintf(w, "%s: added\n", name)
+		default:
+			b, o := base.stations[name], other.stations[name]
+			_, err = fmt.Fprintf(w, "%s: mean %s, min %s, max %s\n", name,
+				base.delta(o.mean()-b.mean()),
+				base.delta(float64(o.min-b.min)/10),
+				base.delta(float64(o.max-b.max)/10))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delta formats a change in temperature with an explicit sign. Changes
+// that round to zero are printed unsigned.
+func (r *report) delta(d float64) string {
+	s := r.temp(d)
+	switch {
+	case strings.Trim(s, "-0.") == "":
+		return r.temp(0)
+	case d > 0:
+		return "+" + s
+	}
+	return s
+}
+
+// ndjsonLine is one -format ndjson record: a station's jsonStats with its
+// name alongside.
+type ndjsonLine struct {
+	Station string `json:"station"`
+	jsonStats
+}
+
+// writeNDJSON prints one JSON object per station in names order, each on
+// its own line, so consumers can process stations as they arrive.
+func writeNDJSON(w io.Writer, r *report) error {
+	enc := json.NewEncoder(w)
+	for _, station := range r.names {
+		line := ndjsonLine{Station: station, jsonStats: r.jsonStats(r.stations[station])}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBuffered writes rep to w with write through a bufio.Writer, so
+// each station does not cost a separate write syscall.
+func writeBuffered(w io.Writer, write func(io.Writer, *report) error, rep *report) error {
+	bw := bufio.NewWriter(w)
+	if err := write(bw, rep); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeFile writes rep to the file at path with write, replacing any
+// existing contents.
+func writeFile(path string, write func(io.Writer, *report) error, rep *report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeBuffered(f, write, rep); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compareOutput checks got against the reference output want line by
+// line, describing up to maxMismatches differences on w. It returns the
+// number of lines that differ.
+func compareOutput(w io.Writer, want, got []byte) int {
+	wantLines := strings.Split(strings.TrimSuffix(string(want), "\n"), "\n")
+	gotLines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+
+	mismatches := 0
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var wantLine, gotLine string
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if wantLine == gotLine {
+			continue
+		}
+		mismatches++
+		if mismatches > maxMismatches {
+			continue
+		}
+		wantName, wantValue := splitResultLine(wantLine)
+		gotName, gotValue := splitResultLine(gotLine)
+		if wantName == gotName {
+			fmt.Fprintf(w, "line %d: %s: expected %s, got %s\n", i+1, wantName, wantValue, gotValue)
+		} else {
+			fmt.Fprintf(w, "line %d: expected %q, got %q\n", i+1, wantLine, gotLine)
+		}
+	}
+	if mismatches > maxMismatches {
+		fmt.Fprintf(w, "... and %d more\n", mismatches-maxMismatches)
+	}
+	return mismatches
+}
+
+// splitResultLine splits a station=values output line at its last =.
+func splitResultLine(line string) (station, values string) {
+	i := strings.LastIndexByte(line, '=')
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// startCPUProfile begins writing a CPU profile to path. The returned
+// function stops the profile and closes the file.
+func startCPUProfile(path string) (stop func() error, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		pprof.StopCPUProfile()
+		return f.Close()
+	}, nil
+}
+
+// writeHeapProfile writes a heap profile, taken after a garbage
+// collection, to path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sectionScanSize is how far boundaryAfter reads at a time while looking
+// for the end of a record.
+const sectionScanSize = 64 * 1024
+
+// processSections aggregates the text in the first size bytes of f with
+// the given number of workers, each reading its own section through
+// ReadAt. Partial results are merged in section order so the sums match
+// a sequential scan. The file is never mapped, so it may be larger than
+// the address space the process is allowed. ok is false, with nothing
+// read, if f is gzip-compressed and has to be streamed instead.
+func processSections(f *os.File, size int64, workers int, opts parseOptions) (agg *aggregation, ok bool, err error) {
+	head := make([]byte, len(utf8BOM))
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	head = head[:n]
+	if bytes.HasPrefix(head, gzipMagic) {
+		return nil, false, nil
+	}
+	rest, err := stripBOM(head)
+	if err != nil {
+		return nil, true, err
+	}
+	start := int64(len(head) - len(rest))
+
+	first := newAggregation(opts)
+	end, err := boundaryAfter(f, start, size, opts.delim)
+	if err != nil {
+		return nil, true, err
+	}
+	line := make([]byte, end-start)
+	if _, err := f.ReadAt(line, start); err != nil && err != io.EOF {
+		return nil, true, err
+	}
+	if !first.checkHeader(bytes.TrimSuffix(line, []byte{opts.delim})) {
+		start = end
+	}
+
+	bounds := []int64{start}
+	for i := 1; i < workers; i++ {
+		from := start + (size-start)*int64(i)/int64(workers)
+		if prev := bounds[len(bounds)-1]; from < prev {
+			from = prev
+		}
+		end, err := boundaryAfter(f, from, size, opts.delim)
+		if err != nil {
+			return nil, true, err
+		}
+		if end > bounds[len(bounds)-1] && end < size {
+			bounds = append(bounds, end)
+		}
+	}
+	bounds = append(bounds, size)
+
+	partials := make([]*aggregation, len(bounds)-1)
+	errs := make([]error, len(partials))
+	var wg sync.WaitGroup
+	for i := range partials {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			partials[i], errs[i] = parseSection(io.NewSectionReader(f, bounds[i], bounds[i+1]-bounds[i]), opts)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, true, err
+		}
+	}
+
+	agg = partials[0]
+	for _, partial := range partials[1:] {
+		agg.merge(partial)
+	}
+	agg.suspectHeader = first.suspectHeader
+	return agg, true, nil
+}
+
+// boundaryAfter returns the offset just past the first delim at or after
+// from in f, or size if there is none.
+func boundaryAfter(f *os.File, from, size int64, delim byte) (int64, error) {
+	buf := make([]byte, sectionScanSize)
+	for from < size {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-from)], from)
+		if i := bytes.IndexByte(buf[:n], delim); i >= 0 {
+			return from + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		from += int64(n)
+		if n == 0 {
+			break
+		}
+	}
+	return size, nil
+}
+
+// parseSection aggregates the opts.delim-terminated records in r,
+// including a final record without a terminator. BOM and header handling
+// is left to the caller.
+func parseSection(r io.Reader, opts parseOptions) (*aggregation, error) {
+	agg := newAggregation(opts)
+	// Records are split straight out of a maxLineSize buffer, like
+	// bufio.Scanner would but without its per-token bookkeeping. The
+	// unfinished record at the end of each read moves to the front.
+	buf := make([]byte, maxLineSize)
+	carry := 0
+	for {
+		n, err := io.ReadFull(r, buf[carry:])
+		data := buf[:carry+n]
+		for {
+			i := bytes.IndexByte(data, opts.delim)
+			if i < 0 {
+				break
+			}
+			agg.addLine(data[:i])
+			data = data[i+1:]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if len(data) > 0 {
+				agg.addLine(data)
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(data) == len(buf) {
+			return nil, bufio.ErrTooLong
+		}
+		carry = copy(buf, data)
+	}
+	agg.flushProgress()
+	return agg, nil
+}
+
+// processInput aggregates the file at path, or stdin if path is "-".
+func processInput(path string, workers int, opts parseOptions) (*aggregation, error) {
+	if opts.binary {
+		return processBinaryInput(path, opts)
+	}
+	if path != "-" {
+		return processFile(path, workers, opts)
+	}
+	// Redirected from a file, stdin is read in parallel like a named
+	// file; this is how the tournament runs submissions.
+	return processOpenFile(os.Stdin, workers, opts)
+}
+
+// inputName describes path in messages.
+func inputName(path string) string {
+	if path == "-" {
+		return "stdin"
+	}
+	return path
+}
+
+// follower tails a plain text file for -follow. Each poll feeds the
+// lines appended since the last one into a running aggregation, so the
+// file is only read once. If the file shrinks or the path now names a
+// different file, as after truncation or log rotation, the follower
+// starts over from the top with an empty aggregation.
+type follower struct {
+	path    string
+	opts    parseOptions
+	f       *os.File
+	offset  int64
+	partial []byte
+	first   bool
+	agg     *aggregation
+}
+
+// reset (re)opens fl.path and discards everything read so far.
+func (fl *follower) reset() error {
+	if fl.f != nil {
+		fl.f.Close()
+		fl.f = nil
+	}
+	f, err := os.Open(fl.path)
+	if err != nil {
+		return err
+	}
+	fl.f = f
+	fl.offset = 0
+	fl.partial = nil
+	fl.first = true
+	fl.agg = newAggregation(fl.opts)
+	return nil
+}
+
+// poll reads whatever has been appended since the previous poll. A line
+// without its trailing delimiter is held back until the rest arrives.
+func (fl *follower) poll() error {
+	if fl.f == nil {
+		if err := fl.reset(); err != nil {
+			return err
+		}
+	} else if err := fl.checkReplaced(); err != nil {
+		return err
+	}
+	if fl.agg.done() {
+		// -limit has been reached; nothing more will be aggregated.
+		return nil
+	}
+
+	data, err := io.ReadAll(fl.f)
+	if err != nil {
+		return err
+	}
+	atStart := fl.offset == 0
+	fl.offset += int64(len(data))
+	if atStart {
+		if data, err = stripBOM(data); err != nil {
+			return err
+		}
+	}
+	if len(fl.partial) > 0 {
+		data = append(fl.partial, data...)
+	}
+	for !fl.agg.done() {
+		i := bytes.IndexByte(data, fl.opts.delim)
+		if i < 0 {
+			break
+		}
+		line := data[:i]
+		data = data[i+1:]
+		if fl.first {
+			fl.first = false
+			if !fl.agg.checkHeader(line) {
+				continue
+			}
+		}
+		fl.agg.addLine(line)
+	}
+	fl.partial = nil
+	if !fl.agg.done() {
+		fl.partial = append(fl.partial, data...)
+	}
+	fl.agg.flushProgress()
+	return nil
+}
+
+// checkReplaced resets the follower if the open file was truncated or
+// fl.path was moved aside and recreated. While the path is missing,
+// mid-rotation, the open file keeps being read.
+func (fl *follower) checkReplaced() error {
+	open, err := fl.f.Stat()
+	if err != nil {
+		return err
+	}
+	cur, err := os.Stat(fl.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !os.SameFile(open, cur) || open.Size() < fl.offset {
+		return fl.reset()
+	}
+	return nil
+}
+
+// follow polls path every interval and hands emit the running
+// aggregation after each poll. It only returns on error.
+func follow(path string, interval time.Duration, opts parseOptions, emit func(*aggregation) error) error {
+	fl := &follower{path: path, opts: opts}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := fl.poll(); err != nil {
+			return err
+		}
+		if err := emit(fl.agg); err != nil {
+			return err
+		}
+		<-ticker.C
+	}
+}
+
+// startProgress prints the number of lines counted so far, with the
+// elapsed time, to w every progressInterval. The returned function stops
+// the reporting and waits for it to finish.
+func startProgress(w io.Writer, lines *atomic.Int64) (stop func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				elapsed := now.Sub(start)
+				n := lines.Load()
+				fmt.Fprintf(w, "processed %d lines in %s (%.0f lines/s)\n",
+					n, elapsed.Round(time.Second), float64(n)/elapsed.Seconds())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// stdinIsPiped reports whether stdin is a pipe or redirected file rather
+// than an interactive terminal.
+func stdinIsPiped() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice == 0
+}
+
+// genStation is a station name with the range its generated readings
+// are drawn from, in whole degrees.
+type genStation struct {
+	name     string
+	min, max int
+}
+
+// genStations seeds the names used by the gen subcommand, taken from
+// scripts/generate-dataset.py.
+var genStations = []genStation{
+	{"Abidjan", 20, 35}, {"Abuja", 18, 38}, {"Accra", 22, 32}, {"Addis Ababa", 8, 28},
+	{"Alexandria", 8, 32}, {"Algiers", 5, 35}, {"Bamako", 18, 40}, {"Cairo", 8, 38},
+	{"Casablanca", 8, 32}, {"Dakar", 18, 35}, {"Djibouti", 22, 42}, {"Durban", 8, 32},
+	{"Johannesburg", 2, 30}, {"Khartoum", 15, 42}, {"Lagos", 20, 35}, {"Nairobi", 8, 28},
+	{"Niamey", 18, 42}, {"Yaoundé", 18, 32}, {"Abu Dhabi", 15, 45}, {"Ahmedabad", 12, 42},
+	{"Almaty", -25, 35}, {"Amman", 5, 38}, {"Christchurch", 2, 25}, {"Darwin", 15, 35},
+	{"Hobart", 2, 25}, {"Melbourne", 5, 30}, {"Perth", 8, 35}, {"Sydney", 5, 30},
+	{"Wellington", 5, 22}, {"Barcelona", 2, 35}, {"Berlin", -10, 32}, {"Brussels", -8, 28},
+	{"Bucharest", -12, 35}, {"Copenhagen", -12, 25}, {"Dublin", -5, 25}, {"Hamburg", -10, 28},
+	{"Helsinki", -20, 25}, {"Istanbul", -5, 35}, {"Krakow", -12, 30}, {"Lisbon", 2, 32},
+	{"London", -5, 28}, {"Madrid", -5, 38}, {"Moscow", -25, 30}, {"Oslo", -15, 25},
+	{"Paris", -5, 32}, {"Prague", -12, 30}, {"Rome", 2, 35}, {"Stockholm", -15, 25},
+	{"Vienna", -10, 30}, {"Warsaw", -15, 30}, {"Zurich", -8, 30},
+}
+
+// generate writes rows random station=temperature lines to w, using n
+// stations. Stations beyond len(genStations) reuse a base station's
+// range under a numbered name. The output depends only on seed.
+func generate(w io.Writer, rows int64, n int, seed int64) error {
+	stations := make([]genStation, n)
+	for i := range stations {
+		base := genStations[i%len(genStations)]
+		if i >= len(genStations) {
+			base.name = fmt.Sprintf("%s %d", base.name, i/len(genStations)+1)
+		}
+		stations[i] = base
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	bw := bufio.NewWriter(w)
+	for i := int64(0); i < rows; i++ {
+		st := stations[rng.Intn(n)]
+		tenths := st.min*10 + rng.Intn((st.max-st.min)*10+1)
+		if _, err := fmt.Fprintf(bw, "%s=%.1f\n", st.name, float64(tenths)/10); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// binaryEncoder writes measurements in the encode subcommand's format:
+// binaryMagic, then one record per reading. A record is the station's id
+// as a uvarint followed by the temperature in tenths as a little-endian
+// int16. Ids are handed out in order of first appearance, and the record
+// that introduces a new id carries the station name, as a uvarint length
+// and the name bytes, between the two.
+type binaryEncoder struct {
+	w   *bufio.Writer
+	ids map[string]uint64
+	buf []byte
+}
+
+func newBinaryEncoder(w io.Writer) (*binaryEncoder, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(binaryMagic); err != nil {
+		return nil, err
+	}
+	return &binaryEncoder{w: bw, ids: make(map[string]uint64)}, nil
+}
+
+func (e *binaryEncoder) encode(name []byte, temp int32) error {
+	id, ok := e.ids[string(name)]
+	if !ok {
+		id = uint64(len(e.ids))
+		e.ids[string(name)] = id
+	}
+	b := binary.AppendUvarint(e.buf[:0], id)
+	if !ok {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(int16(temp)))
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *binaryEncoder) flush() error {
+	return e.w.Flush()
+}
+
+// encodeText converts text measurements from r into the binary format on
+// w, splitting records at opts.delim and names from temperatures at
+// opts.sep. With opts.skipHeader the first record is dropped; lines that
+// do not parse are left out and counted.
+func encodeText(w io.Writer, r io.Reader, opts parseOptions) (skipCounts, error) {
+	var skipped skipCounts
+	enc, err := newBinaryEncoder(w)
+	if err != nil {
+		return skipped, err
+	}
+	br := bufio.NewReader(r)
+	if err := skipBOM(br); err != nil {
+		return skipped, err
+	}
+	scanner := newLineScanner(br, opts.delim)
+	if opts.skipHeader {
+		scanner.Scan()
+	}
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte{'\r'})
+		i := bytes.LastIndexByte(line, opts.sep)
+		if i < 0 {
+			skipped.separator++
+			continue
+		}
+		temp, ok := parseTemp(line[i+1:])
+		if !ok {
+			skipped.number++
+			continue
+		}
+		if err := enc.encode(line[:i], temp); err != nil {
+			return skipped, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return skipped, err
+	}
+	return skipped, enc.flush()
+}
+
+// errBadBinary reports input given with -binary that is not in the
+// encode subcommand's format.
+var errBadBinary = errors.New("not a binary measurements file")
+
+// processBinary aggregates measurements in the binary format from r.
+// Results match those of processReader on the text the data was encoded
+// from, apart from the skipped lines, which were dropped at encode time.
+func processBinary(r io.Reader, opts parseOptions) (*aggregation, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, binaryMagic) {
+		return nil, errBadBinary
+	}
+
+	agg := newAggregation(opts)
+	var names [][]byte
+	var ids []*stats // stats by station id, looked up on first use
+	var buf [2]byte
+	for !agg.done() {
+		id, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case id == uint64(len(names)):
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, noEOF(err)
+			}
+			if n > maxLineSize {
+				return nil, fmt.Errorf("station name of %d bytes: %w", n, errBadBinary)
+			}
+			name := make([]byte, n)
+			if _, err := io.ReadFull(br, name); err != nil {
+				return nil, noEOF(err)
+			}
+			if opts.foldCase {
+				name = bytes.ToLower(name)
+			}
+			names = append(names, name)
+			ids = append(ids, nil)
+		case id > uint64(len(names)):
+			return nil, fmt.Errorf("station id %d before it was defined: %w", id, errBadBinary)
+		}
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return nil, noEOF(err)
+		}
+		temp := int32(int16(binary.LittleEndian.Uint16(buf[:])))
+		agg.countLine()
+		if agg.outlier(names[id], temp) && opts.dropOutliers {
+			continue
+		}
+		if opts.checkOnly {
+			agg.rows++
+			continue
+		}
+		if ids[id] == nil {
+			ids[id] = agg.station(names[id])
+		}
+		agg.addTo(ids[id], temp)
+	}
+	agg.flushProgress()
+	return agg, nil
+}
+
+// noEOF turns an io.EOF part way through a binary record into
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// processBinaryInput opens path, or stdin for "-", and reads it with
+// processBinary.
+func processBinaryInput(path string, opts parseOptions) (*aggregation, error) {
+	if path == "-" {
+		return processBinary(os.Stdin, opts)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return processBinary(f, opts)
+}
+
+// runEncode implements the encode subcommand.
+func runEncode(args []string) {
+	fs := flag.NewFlagSet("encode", flag.ExitOnError)
+	out := fs.String("out", "-", "file to write, or - for stdout")
+	sep := fs.String("sep", "=", "single byte separating station name from temperature")
+	delim := fs.String("delim", `\n`, "byte terminating each record, e.g. \\0 for NUL-separated input")
+	skipHeader := fs.Bool("skip-header", false, "leave the first line of the input out of the encoding")
+	fs.Parse(args)
+
+	if len(*sep) != 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -sep %q: must be a single byte\n", *sep)
+		os.Exit(2)
+	}
+	delimByte, err := parseDelim(*delim)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	opts := parseOptions{sep: (*sep)[0], delim: delimByte, skipHeader: *skipHeader}
+	path := defaultInput
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		path = fs.Arg(0)
+	default:
+		fmt.Fprintln(os.Stderr, "encode takes at most one input file")
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		in, err = os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", inputName(path), err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+	r, err := gunzipIfCompressed(bufio.NewReader(in))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", inputName(path), err)
+		os.Exit(1)
+	}
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *out != "-" {
+		f, err = os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output: %v\n", err)
+			os.Exit(1)
+		}
+		w = f
+	}
+	skipped, err := encodeText(w, r, opts)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding %s: %v\n", inputName(path), err)
+		os.Exit(1)
+	}
+	if n := skipped.total(); n > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d lines (%d missing separator, %d bad number)\n",
+			n, skipped.separator, skipped.number)
+	}
+}
+
+// runGen implements the gen subcommand.
+func runGen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	rows := fs.Int64("rows", 1000000, "number of lines to generate")
+	numStations := fs.Int("stations", 413, "number of distinct stations")
+	out := fs.String("out", "-", "file to write, or - for stdout")
+	seed := fs.Int64("seed", 1, "random seed; the same seed always produces the same data")
+	fs.Parse(args)
+
+	if *numStations < 1 {
+		fmt.Fprintln(os.Stderr, "-stations must be at least 1")
+		os.Exit(2)
+	}
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *out != "-" {
+		var err error
+		f, err = os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output: %v\n", err)
+			os.Exit(1)
+		}
+		w = f
+	}
+	err := generate(w, *rows, *numStations, *seed)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 func main() {
-	stations := make(map[string][]float64)
-	
-	file, err := os.Open("data/test_measurements.txt")
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		runGen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encode" {
+		runEncode(os.Args[2:])
+		return
+	}
+
+	inputPath := flag.String("input", defaultInput, "path to the measurements file, or - for stdin; ignored when files are given as arguments")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of goroutines used to parse a file")
+	strict := flag.Bool("strict", false, "exit non-zero if any input line was skipped")
+	format := flag.String("format", "text", "output format: text, json, ndjson, csv or table")
+	top := flag.Int("top", 0, "print only the N stations with the highest mean (0 prints all)")
+	median := flag.Bool("median", false, "print the median instead of the mean; retains every reading in memory")
+	collapseRuns := flag.Bool("collapse-repeats", false, "with -median, store a station's consecutive identical readings as one counted run")
+	verbose := flag.Bool("verbose", false, "with -median, print both the mean and the median")
+	round := flag.Int("round", 1, "decimal places in printed temperatures; negative prints full precision")
+	stddev := flag.Bool("stddev", false, "append the population standard deviation to each station")
+	progress := flag.Bool("progress", false, "periodically report the number of lines processed on stderr")
+	sep := flag.String("sep", "=", "single character separating station name from temperature")
+	delim := flag.String("delim", `\n`, "byte terminating each record, e.g. \\0 for NUL-separated input")
+	foldCase := flag.Bool("fold-case", false, "merge station names case-insensitively, printing them in lower case")
+	filter := flag.String("filter", "", "print only stations whose name contains this substring")
+	sortMode := flag.String("sort", "bytes", "station ordering: bytes, or unicode for case-insensitive code point order")
+	sortBy := flag.String("sort-by", "name", "order stations by name, mean, min or max")
+	desc := flag.Bool("desc", false, "reverse the -sort-by order")
+	stationsHint := flag.Int("stations-hint", defaultStationsHint, "expected number of distinct stations, used to pre-size the station map")
+	limit := flag.Int64("limit", 0, "aggregate only the first N valid lines (0 means no limit)")
+	output := flag.String("output", "", "write the results to this file instead of stdout")
+	keepGoing := flag.Bool("keep-going", false, "report unreadable input files and carry on with the rest")
+	expected := flag.String("expected", "", "compare the results against this reference output instead of printing them")
+	skipHeader := flag.Bool("skip-header", false, "ignore the first line of each input file")
+	plausible := flag.String("range", "", "warn about readings outside min:max, e.g. -99.9:99.9")
+	dropOutliers := flag.Bool("drop-outliers", false, "with -range, leave readings outside the range out of the results")
+	summary := flag.Bool("summary", false, "append an ALL line aggregating every measurement (text format only)")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile of the aggregation to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile taken after aggregation to this file")
+	quiet := flag.Bool("quiet", false, "aggregate without printing results; report the elapsed time and row count on stderr")
+	binaryInput := flag.Bool("binary", false, "read inputs written by the encode subcommand instead of text")
+	check := flag.Bool("check", false, "only validate the input: count valid and invalid lines, including readings outside -range, and print a report")
+	floatFormat := flag.String("fmt", "%.1f", "Go format verb for each temperature in text, csv and table output, applied after -round")
+	compare := flag.String("compare", "", "also aggregate this file and print how each station's mean, min and max changed from the input to it")
+	followMode := flag.Bool("follow", false, "keep reading lines appended to the input file and print a fresh snapshot every -interval")
+	interval := flag.String("interval", "5", "time between -follow snapshots, in seconds or as a duration such as 500ms")
+	flag.Parse()
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if *collapseRuns && !*median {
+		fmt.Fprintln(os.Stderr, "-collapse-repeats requires -median")
+		os.Exit(2)
+	}
+
+	if *round > maxRound {
+		fmt.Fprintf(os.Stderr, "Invalid -round %d: at most %d decimal places are supported\n", *round, maxRound)
+		os.Exit(2)
+	}
+
+	if *summary && *format != "text" {
+		fmt.Fprintln(os.Stderr, "-summary is only supported with -format text")
+		os.Exit(2)
+	}
+
+	if *quiet && (*output != "" || *expected != "" || *compare != "") {
+		fmt.Fprintln(os.Stderr, "-quiet cannot be used with -output, -expected or -compare")
+		os.Exit(2)
+	}
+
+	if setFlags["fmt"] {
+		if err := checkFloatFormat(*floatFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -fmt: %v\n", err)
+			os.Exit(2)
+		}
+		if *format == "json" || *format == "ndjson" || *compare != "" {
+			fmt.Fprintln(os.Stderr, "-fmt cannot be used with JSON output or -compare")
+			os.Exit(2)
+		}
+	}
+
+	if *check && (*compare != "" || *expected != "" || *output != "" || *followMode) {
+		fmt.Fprintln(os.Stderr, "-check prints only its report and cannot be used with -compare, -expected, -output or -follow")
+		os.Exit(2)
+	}
+
+	if *compare != "" {
+		if *format != "text" || *summary || *expected != "" || *followMode {
+			fmt.Fprintln(os.Stderr, "-compare prints its own text format and cannot be used with -format, -summary, -expected or -follow")
+			os.Exit(2)
+		}
+	}
+
+	var followInterval time.Duration
+	if *followMode {
+		if *quiet || *output != "" || *expected != "" {
+			fmt.Fprintln(os.Stderr, "-follow prints to stdout and cannot be used with -quiet, -output or -expected")
+			os.Exit(2)
+		}
+		if *binaryInput {
+			fmt.Fprintln(os.Stderr, "-follow only reads text input and cannot be used with -binary")
+			os.Exit(2)
+		}
+		if *cpuProfile != "" || *memProfile != "" {
+			fmt.Fprintln(os.Stderr, "-follow runs until interrupted and cannot be used with -cpuprofile or -memprofile")
+			os.Exit(2)
+		}
+		d, err := parseInterval(*interval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -interval: %v\n", err)
+			os.Exit(2)
+		}
+		followInterval = d
+	}
+
+	var write func(io.Writer, *report) error
+	switch *format {
+	case "text":
+		write = writeText
+	case "json":
+		write = writeJSON
+	case "ndjson":
+		write = writeNDJSON
+	case "csv":
+		write = writeCSV
+	case "table":
+		write = writeTable
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -format %q\n", *format)
+		os.Exit(2)
+	}
+
+	if *sortMode != "bytes" && *sortMode != "unicode" {
+		fmt.Fprintf(os.Stderr, "Unknown -sort %q\n", *sortMode)
+		os.Exit(2)
+	}
+
+	if _, ok := sortFields[*sortBy]; !ok && *sortBy != "name" {
+		fmt.Fprintf(os.Stderr, "Unknown -sort-by %q\n", *sortBy)
+		os.Exit(2)
+	}
+
+	if len(*sep) != 1 {
+		fmt.Fprintf(os.Stderr, "-sep must be a single character, got %q\n", *sep)
+		os.Exit(2)
+	}
+
+	delimByte, err := parseDelim(*delim)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *binaryInput && (setFlags["sep"] || setFlags["delim"] || *skipHeader) {
+		fmt.Fprintln(os.Stderr, "-binary input has no separators or header; pass -sep, -delim and -skip-header to encode instead")
+		os.Exit(2)
+	}
+
+	if *stationsHint < 0 {
+		fmt.Fprintln(os.Stderr, "-stations-hint must not be negative")
+		os.Exit(2)
+	}
+
+	var plausibleRange *tempRange
+	if *plausible != "" {
+		plausibleRange, err = parseRange(*plausible)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -range: %v\n", err)
+			os.Exit(2)
+		}
+	} else if *dropOutliers {
+		fmt.Fprintln(os.Stderr, "-drop-outliers requires -range")
+		os.Exit(2)
+	}
+
+	opts := parseOptions{
+		sep:          (*sep)[0],
+		delim:        delimByte,
+		foldCase:     *foldCase,
+		keepValues:   *median,
+		collapseRuns: *collapseRuns,
+		limit:        *limit,
+		skipHeader:   *skipHeader,
+		stationsHint: *stationsHint,
+		binary:       *binaryInput,
+		plausible:    plausibleRange,
+		dropOutliers: *dropOutliers || *check,
+		checkOnly:    *check,
+	}
+	stopProgress := func() {}
+	if *progress {
+		opts.progress = new(atomic.Int64)
+		stopProgress = startProgress(os.Stderr, opts.progress)
+	}
+
+	sortNames := func(names []string) {
+		if *sortMode == "unicode" {
+			sort.Slice(names, func(i, j int) bool { return unicodeLess(names[i], names[j]) })
+		} else {
+			sort.Strings(names)
+		}
+	}
+
+	// buildReport picks, orders and formats the stations to print. It is
+	// shared by the one-shot run and every -follow snapshot.
+	buildReport := func(stations map[string]*stats) *report {
+		// Sort station names, leaving out any without a reading since their
+		// min, mean and max are undefined.
+		var stationNames []string
+		for station, st := range stations {
+			if st.count == 0 {
+				continue
+			}
+			stationNames = append(stationNames, station)
+		}
+		sortNames(stationNames)
+		if err := checkUnique(stationNames); err != nil {
+			fmt.Fprintf(os.Stderr, "Internal error: %v\n", err)
+			os.Exit(1)
+		}
+		if *filter != "" {
+			substr := *filter
+			if *foldCase {
+				substr = strings.ToLower(substr)
+			}
+			stationNames = filterNames(stationNames, substr)
+		}
+		if *top > 0 {
+			stationNames = topByMean(stationNames, stations, *top)
+		}
+		// -top leaves the hottest first, so only re-sort after it if asked to.
+		if *top > 0 && (setFlags["sort-by"] || setFlags["desc"]) {
+			sortNames(stationNames)
+		}
+		if *top == 0 || setFlags["sort-by"] || setFlags["desc"] {
+			sortByField(stationNames, stations, *sortBy, *desc)
+		}
+
+		rep := &report{
+			names:    stationNames,
+			stations: stations,
+			mean:     !*median || *verbose,
+			median:   *median,
+			stddev:   *stddev,
+
+			precision: *round,
+		}
+		if setFlags["fmt"] {
+			rep.floatFormat = *floatFormat
+		}
+		if *summary {
+			rep.summary = combine(stations)
+			for _, st := range stations {
+				if st.count > 0 {
+					rep.summaryStations++
+				}
+			}
+		}
+		return rep
+	}
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		if !setFlags["input"] && stdinIsPiped() {
+			paths = []string{"-"}
+		} else {
+			paths = []string{*inputPath}
+		}
+	}
+
+	if *followMode {
+		if len(paths) != 1 || paths[0] == "-" {
+			fmt.Fprintln(os.Stderr, "-follow needs exactly one input file")
+			os.Exit(2)
+		}
+		snapshots := 0
+		err := follow(paths[0], followInterval, opts, func(agg *aggregation) error {
+			if snapshots > 0 {
+				fmt.Println(followMarker)
+			}
+			snapshots++
+			return writeBuffered(os.Stdout, write, buildReport(agg.stations))
+		})
+		stopProgress()
+		fmt.Fprintf(os.Stderr, "Error following %s: %v\n", paths[0], err)
 		os.Exit(1)
 	}
-	defer file.Close()
-	
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), "=")
-		if len(parts) == 2 {
-			station := parts[0]
-			temp, err := strconv.ParseFloat(parts[1], 64)
-			if err == nil {
-				stations[station] = append(stations[station], temp)
-			}
-		}
-	}
-	
-	// Sort station names
-	var stationNames []string
-	for station := range stations {
-		stationNames = append(stationNames, station)
-	}
-	sort.Strings(stationNames)
-	
-	for _, station := range stationNames {
-		temps := stations[station]
-		min := temps[0]
-		max := temps[0]
-		sum := temps[0]
-		
-		for _, temp := range temps[1:] {
-			if temp < min {
-				min = temp
-			}
-			if temp > max {
-				max = temp
-			}
-			sum += temp
-		}
-		
-		mean := sum / float64(len(temps))
-		fmt.Printf("%s=%.1f/%.1f/%.1f\n", station, min, mean, max)
+
+	stopCPUProfile := func() error { return nil }
+	if *cpuProfile != "" {
+		stopCPUProfile, err = startCPUProfile(*cpuProfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting CPU profile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	start := time.Now()
+	agg := newAggregation(opts)
+	for _, path := range paths {
+		pathOpts := opts
+		if opts.limit > 0 {
+			if agg.done() {
+				break
+			}
+			pathOpts.limit = opts.limit - agg.rows
+		}
+		partial, err := processInput(path, *workers, pathOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", inputName(path), err)
+			if !*keepGoing {
+				os.Exit(1)
+			}
+			continue
+		}
+		if partial.suspectHeader != "" {
+			fmt.Fprintf(os.Stderr, "warning: first line of %s (%q) has no valid temperature; use -skip-header if it is a header\n",
+				inputName(path), partial.suspectHeader)
+		}
+		agg.merge(partial)
+	}
+	stopProgress()
+	elapsed := time.Since(start)
+	if err := stopCPUProfile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing CPU profile: %v\n", err)
+		os.Exit(1)
+	}
+	if *memProfile != "" {
+		if err := writeHeapProfile(*memProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing heap profile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *check {
+		// Readings outside -range were dropped, so rows counts only the
+		// valid lines.
+		invalid := agg.skipped.total() + agg.outliers
+		fmt.Printf("checked %d lines: %d valid, %d invalid (%d missing separator, %d bad number",
+			agg.rows+invalid, agg.rows, invalid, agg.skipped.separator, agg.skipped.number)
+		if plausibleRange != nil {
+			fmt.Printf(", %d outside %s", agg.outliers, *plausible)
+		}
+		fmt.Println(")")
+		if len(agg.outlierNames) > 0 {
+			fmt.Printf("readings outside %s from %s\n", *plausible, strings.Join(agg.outlierNames, ", "))
+		}
+		if *strict && invalid > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	rep := buildReport(agg.stations)
+	var other *aggregation // the -compare file's results
+	if *compare != "" {
+		other, err = processInput(*compare, *workers, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", inputName(*compare), err)
+			os.Exit(1)
+		}
+		if other.suspectHeader != "" {
+			fmt.Fprintf(os.Stderr, "warning: first line of %s (%q) has no valid temperature; use -skip-header if it is a header\n",
+				inputName(*compare), other.suspectHeader)
+		}
+		otherRep := buildReport(other.stations)
+		write = func(w io.Writer, r *report) error {
+			return writeComparison(w, r, otherRep, sortNames)
+		}
+	}
+	mismatched := false
+	if *quiet {
+		fmt.Fprintf(os.Stderr, "aggregated %d rows across %d stations in %s\n",
+			agg.rows, len(rep.names), elapsed)
+	} else if *expected != "" {
+		want, err := os.ReadFile(*expected)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading expected output: %v\n", err)
+			os.Exit(1)
+		}
+		var got bytes.Buffer
+		if err := write(&got, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(1)
+		}
+		if n := compareOutput(os.Stderr, want, got.Bytes()); n > 0 {
+			fmt.Fprintf(os.Stderr, "%d lines differ from %s\n", n, *expected)
+			mismatched = true
+		}
+	} else if *output != "" {
+		if err := writeFile(*output, write, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(1)
+		}
+	} else if err := writeBuffered(os.Stdout, write, rep); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+
+	// warn reports a's outliers and skipped lines, naming the input they
+	// came from if from is set, and returns the number skipped.
+	warn := func(a *aggregation, from string) int64 {
+		in := ""
+		if from != "" {
+			in = " in " + inputName(from)
+		}
+		if a.outliers > 0 {
+			action := "kept"
+			if *dropOutliers {
+				action = "dropped"
+			}
+			fmt.Fprintf(os.Stderr, "warning: %s %d readings outside %s%s, e.g. from %s\n",
+				action, a.outliers, *plausible, in, strings.Join(a.outlierNames, ", "))
+		}
+		n := a.skipped.total()
+		if n > 0 {
+			fmt.Fprintf(os.Stderr, "skipped %d lines%s (%d missing separator, %d bad number)\n",
+				n, in, a.skipped.separator, a.skipped.number)
+		}
+		return n
+	}
+	skipped := warn(agg, "")
+	if other != nil {
+		skipped += warn(other, *compare)
+	}
+	if skipped > 0 && *strict {
+		os.Exit(1)
+	}
+	if mismatched {
+		os.Exit(1)
 	}
 }